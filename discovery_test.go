@@ -0,0 +1,107 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeResolver is a canned Resolver for tests, so refresh/browse can be
+// exercised without a live network.
+type fakeResolver struct {
+	entries []*ServiceEntry
+}
+
+func (f *fakeResolver) Scan(ctx context.Context, timeout time.Duration) (<-chan *ServiceEntry, error) {
+	out := make(chan *ServiceEntry, len(f.entries))
+	for _, e := range f.entries {
+		out <- e
+	}
+	close(out)
+	return out, nil
+}
+
+func TestDiscoveryRefreshBuildsTargetGroups(t *testing.T) {
+	dd := &Discovery{
+		interval: time.Hour,
+		newResolver: func(name string) Resolver {
+			return &fakeResolver{entries: []*ServiceEntry{
+				{
+					Name:   "myhost._prometheus-http._tcp.local.",
+					Host:   "myhost.local.",
+					AddrV4: net.ParseIP("10.0.0.1"),
+					Port:   9100,
+				},
+			}}
+		},
+	}
+
+	reg := newServiceRegistry()
+	notified := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := dd.refresh(ctx, ServiceSpec{Name: "_prometheus-http._tcp"}, reg, notify); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	select {
+	case <-notified:
+	default:
+		t.Fatal("expected notify to be called")
+	}
+
+	groups := reg.snapshot()
+	if len(groups) != 1 {
+		t.Fatalf("got %d target groups, want 1", len(groups))
+	}
+	if got := groups[0].Targets[0]; got != "10.0.0.1:9100" {
+		t.Errorf("target = %q, want 10.0.0.1:9100", got)
+	}
+}
+
+func TestDiscoveryRefreshHandlesGoodbye(t *testing.T) {
+	reg := newServiceRegistry()
+	reg.upsert("myhost._prometheus-http._tcp.local", &TargetGroup{Targets: []string{"10.0.0.1:9100"}}, time.Hour, func() {})
+
+	dd := &Discovery{
+		interval: time.Hour,
+		newResolver: func(name string) Resolver {
+			return &fakeResolver{entries: []*ServiceEntry{
+				{Name: "myhost._prometheus-http._tcp.local.", Goodbye: true},
+			}}
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := dd.refresh(ctx, ServiceSpec{Name: "_prometheus-http._tcp"}, reg, func() {}); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	if got := len(reg.snapshot()); got != 0 {
+		t.Fatalf("snapshot length after goodbye = %d, want 0", got)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// httpSDServer serves the last-known-good set of target groups in the
+// format expected by Prometheus' http_sd_config. The current payload is
+// stored behind an atomic.Value so that concurrent mDNS refreshes never
+// block or partially-write responses to in-flight requests.
+type httpSDServer struct {
+	refreshInterval time.Duration
+	logger          kitlog.Logger
+
+	current atomic.Value // holds []byte
+}
+
+func newHTTPSDServer(refreshInterval time.Duration, logger kitlog.Logger) *httpSDServer {
+	if logger == nil {
+		logger = kitlog.NewNopLogger()
+	}
+	s := &httpSDServer{refreshInterval: refreshInterval, logger: logger}
+	s.current.Store([]byte("[]"))
+	return s
+}
+
+// Update replaces the payload served to clients. It is safe to call from
+// any goroutine.
+func (s *httpSDServer) Update(body []byte) {
+	s.current.Store(body)
+}
+
+func (s *httpSDServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Prometheus-Refresh-Interval-Seconds", strconv.FormatFloat(s.refreshInterval.Seconds(), 'f', -1, 64))
+	w.Write(s.current.Load().([]byte))
+	level.Debug(s.logger).Log("msg", "served http_sd_config request", "remote", r.RemoteAddr)
+}
+
+// listenAndServe starts the http_sd_config endpoint in the background and
+// logs a fatal error if it ever stops.
+func (s *httpSDServer) listenAndServe(addr string) {
+	level.Info(s.logger).Log("msg", "serving http_sd_config", "addr", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, s); err != nil {
+			level.Error(s.logger).Log("msg", "http_sd_config server stopped", "addr", addr, "err", err)
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	kitlog "github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// labelOverlay holds a set of static labels loaded from a directory (one
+// file per label, filename is the key, contents is the value) that gets
+// merged into every discovered TargetGroup. It can be reloaded at any time
+// without restarting discovery.
+type labelOverlay struct {
+	logger  kitlog.Logger
+	current atomic.Value // holds map[string]string
+}
+
+func newLabelOverlay(logger kitlog.Logger) *labelOverlay {
+	if logger == nil {
+		logger = kitlog.NewNopLogger()
+	}
+	l := &labelOverlay{logger: logger}
+	l.current.Store(map[string]string{})
+	return l
+}
+
+// labels returns the currently loaded overlay labels. The returned map must
+// not be mutated.
+func (l *labelOverlay) labels() map[string]string {
+	return l.current.Load().(map[string]string)
+}
+
+// Reload re-reads dir and replaces the overlay's labels. Each regular file
+// in dir becomes one label: the filename is the key, the trimmed file
+// contents is the value.
+func (l *labelOverlay) Reload(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		labels[entry.Name()] = strings.TrimSpace(string(value))
+	}
+
+	l.current.Store(labels)
+	level.Info(l.logger).Log("msg", "reloaded label overlay", "dir", dir, "labels", len(labels))
+	return nil
+}
+
+// watch reloads the overlay whenever dir changes on disk or the process
+// receives SIGHUP, until ctx is cancelled. Reload errors are swallowed; the
+// overlay just keeps serving its last good set of labels.
+func (l *labelOverlay) watch(ctx context.Context, dir string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		level.Warn(l.logger).Log("msg", "error watching -labels.dir", "dir", dir, "err", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dir); err != nil {
+		level.Warn(l.logger).Log("msg", "error watching -labels.dir", "dir", dir, "err", err)
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := l.Reload(dir); err != nil {
+				level.Warn(l.logger).Log("msg", "error reloading -labels.dir on SIGHUP", "dir", dir, "err", err)
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				if err := l.Reload(dir); err != nil {
+					level.Warn(l.logger).Log("msg", "error reloading -labels.dir", "dir", dir, "err", err)
+				}
+			}
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
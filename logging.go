@@ -0,0 +1,62 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+var (
+	logLevel  = flag.String("log.level", "info", "Minimum log level to log: debug, info, warn or error")
+	logFormat = flag.String("log.format", "logfmt", "Log output format: logfmt or json")
+)
+
+// newLogger builds the process-wide logger from -log.level and
+// -log.format. It's created once in main and threaded through Discovery
+// and its collaborators so every component logs with the same
+// configuration.
+func newLogger() (kitlog.Logger, error) {
+	var logger kitlog.Logger
+	switch strings.ToLower(*logFormat) {
+	case "json":
+		logger = kitlog.NewJSONLogger(kitlog.NewSyncWriter(os.Stderr))
+	case "logfmt":
+		logger = kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	default:
+		return nil, fmt.Errorf("unknown -log.format %q, want logfmt or json", *logFormat)
+	}
+	logger = kitlog.With(logger, "ts", kitlog.DefaultTimestampUTC, "caller", kitlog.DefaultCaller)
+
+	var option level.Option
+	switch strings.ToLower(*logLevel) {
+	case "debug":
+		option = level.AllowDebug()
+	case "info":
+		option = level.AllowInfo()
+	case "warn":
+		option = level.AllowWarn()
+	case "error":
+		option = level.AllowError()
+	default:
+		return nil, fmt.Errorf("unknown -log.level %q, want debug, info, warn or error", *logLevel)
+	}
+
+	return level.NewFilter(logger, option), nil
+}
@@ -25,12 +25,11 @@ import (
 	"os"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
+	kitlog "github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/prometheus/common/model"
-
-	"github.com/hashicorp/mdns"
 )
 
 type TargetGroup struct {
@@ -58,13 +57,23 @@ func (t TargetGroups) Less(i, j int) bool {
 }
 
 var (
-	interval          = flag.Duration("interval", 10*time.Second, "How often to query for services")
-	output            = flag.String("out", "-", "Filename to write output to")
-	ipv4Only          = flag.Bool("4", false, "IPv4 address only")
-	listInterfaceOnly = flag.Bool("l", false, "List interface and exit")
-	iface             = flag.String("i", "", "Interface for multicast")
+	interval            = flag.Duration("interval", 10*time.Second, "How often to query for services")
+	output              = flag.String("out", "-", "Filename to write output to")
+	ipv4Only            = flag.Bool("4", false, "IPv4 address only")
+	listInterfaceOnly   = flag.Bool("l", false, "List interface and exit")
+	iface               = flag.String("i", "", "Interface for multicast")
+	httpListen          = flag.String("http.listen", "", "Address to serve http_sd_config compatible target groups on, e.g. :9999. Disabled if empty")
+	services            serviceSpecs
+	serviceAutoDiscover = flag.Bool("service.auto", false, "Auto-discover advertised service types via _services._dns-sd._udp.local. in addition to -service")
+	labelsDir           = flag.String("labels.dir", "", "Directory of label overlay files (filename is the label key, contents is the value) merged into every target group. Reloaded on change and on SIGHUP. Disabled if empty")
+	dnsServer           = flag.String("dns.server", "", "host:port of a unicast DNS server to fall back to on interfaces where multicast mDNS doesn't work, e.g. Android or locked-down container networks. Disabled if empty")
+	serviceConfig       = flag.String("service.config", "", "Path to a file of service specs, one per line in the same syntax as -service. Merged with -service. Disabled if empty")
 )
 
+func init() {
+	flag.Var(&services, "service", "Service type to browse for, optionally with default labels, e.g. _node-exporter._tcp=scheme:http,job:node. Repeatable. Defaults to _prometheus-http._tcp and _prometheus-https._tcp if unset")
+}
+
 func init() {
 	// hashicorp/mdns outputs a lot of garbage on stdlog, so quiet it down...
 	log.SetOutput(ioutil.Discard)
@@ -78,9 +87,38 @@ func main() {
 		return
 	}
 
+	logger, err := newLogger()
+	if err != nil {
+		// The structured logger itself failed to build, and stdlib log's
+		// output is discarded (see init above), so log.Fatal alone would
+		// exit silently; print directly to stderr first.
+		fmt.Fprintln(os.Stderr, "error creating logger:", err)
+		log.Fatal(err)
+	}
+
 	d := &Discovery{
-		interval: *interval,
-		ifaces:   make([]*net.Interface, 0),
+		interval:             *interval,
+		ifaces:               make([]*net.Interface, 0),
+		services:             services,
+		autoDiscoverServices: *serviceAutoDiscover,
+		dnsServer:            *dnsServer,
+		logger:               logger,
+	}
+
+	if *serviceConfig != "" {
+		fileSpecs, err := loadServiceConfigFile(*serviceConfig)
+		if err != nil {
+			level.Error(logger).Log("msg", "error loading -service.config", "file", *serviceConfig, "err", err)
+			log.Fatal(err)
+		}
+		d.services = append(d.services, fileSpecs...)
+	}
+
+	if len(d.services) == 0 {
+		d.services = serviceSpecs{
+			{Name: "_prometheus-http._tcp"},
+			{Name: "_prometheus-https._tcp"},
+		}
 	}
 
 	if *iface != "" {
@@ -96,7 +134,24 @@ func main() {
 		}
 	}
 
+	var sdServer *httpSDServer
+	if *httpListen != "" {
+		sdServer = newHTTPSDServer(*interval, logger)
+		sdServer.listenAndServe(*httpListen)
+	}
+
 	ctx := context.Background()
+
+	if *labelsDir != "" {
+		overlay := newLabelOverlay(logger)
+		if err := overlay.Reload(*labelsDir); err != nil {
+			level.Error(logger).Log("msg", "error loading -labels.dir at startup", "dir", *labelsDir, "err", err)
+			log.Fatal(err)
+		}
+		go overlay.watch(ctx, *labelsDir)
+		d.labels = overlay
+	}
+
 	ch := make(chan []*TargetGroup)
 
 	go d.Run(ctx, ch)
@@ -119,108 +174,153 @@ func main() {
 			newHash := hasher.Sum64()
 
 			if newHash == oldHash {
+				level.Debug(logger).Log("msg", "target groups unchanged, skipping write", "hash", newHash)
 				continue
 			}
+			level.Info(logger).Log("msg", "target groups changed", "groups", len(targetGroups), "hash", newHash)
 			oldHash = newHash
 
+			if sdServer != nil {
+				sdServer.Update(y)
+			}
+
 			if *output == "-" {
 				fmt.Println(string(y))
 			} else {
 				file, err := os.Create(*output) // For read access.
 				if err != nil {
+					level.Error(logger).Log("msg", "error writing output file", "file", *output, "err", err)
 					log.Fatal(err)
 				}
 				file.Write(y)
 				file.Close()
+				level.Info(logger).Log("msg", "wrote output file", "file", *output)
 			}
 		}
 	}()
 }
 
-// Discovery periodically performs DNS-SD requests. It implements
+// Discovery continuously performs DNS-SD requests. It implements
 // the TargetProvider interface.
 type Discovery struct {
 	interval time.Duration
 	ifaces   []*net.Interface
+	services serviceSpecs
+
+	// autoDiscoverServices additionally enumerates advertised service types
+	// via the _services._dns-sd._udp meta-service before browsing.
+	autoDiscoverServices bool
+
+	// labels, if set, is merged into every emitted TargetGroup's Labels.
+	labels *labelOverlay
+
+	// dnsServer is the unicast fallback used by the default Resolver; see
+	// mdnsResolver.
+	dnsServer string
+
+	// newResolver constructs the Resolver used to scan for a given service
+	// name. Defaults to a production mdnsResolver; overridable in tests.
+	newResolver func(name string) Resolver
+
+	logger kitlog.Logger
 }
 
-// Run implements the TargetProvider interface.
+// Run implements the TargetProvider interface. Rather than tearing down and
+// re-issuing a full batch of queries every interval, it keeps a long-lived
+// browser goroutine per service type running and reacts to individual
+// responses as they arrive, emitting a fresh snapshot of the registry
+// whenever an entry is added, updated or expires.
 func (dd *Discovery) Run(ctx context.Context, ch chan<- []*TargetGroup) {
 	defer close(ch)
 
-	ticker := time.NewTicker(dd.interval)
-	defer ticker.Stop()
+	if dd.logger == nil {
+		dd.logger = kitlog.NewNopLogger()
+	}
+	if dd.newResolver == nil {
+		dd.newResolver = func(name string) Resolver {
+			return newMDNSResolver(name, dd.ifaces, dd.dnsServer, dd.logger)
+		}
+	}
+
+	specs := dd.services
+	if dd.autoDiscoverServices {
+		names, err := discoverServiceNames(ctx, dd)
+		if err != nil {
+			level.Warn(dd.logger).Log("msg", "error auto-discovering service types", "err", err)
+		}
+		level.Info(dd.logger).Log("msg", "auto-discovered service types", "count", len(names))
+		for _, name := range names {
+			specs = append(specs, ServiceSpec{Name: name})
+		}
+	}
+
+	reg := newServiceRegistry()
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
 
-	// Get an initial set right away.
-	dd.refreshAll(ctx, ch)
+	for _, spec := range specs {
+		go dd.browse(ctx, spec, reg, notify)
+	}
 
 	for {
 		select {
-		case <-ticker.C:
-			dd.refreshAll(ctx, ch)
+		case <-changed:
+			ch <- reg.snapshot()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (dd *Discovery) refreshAll(ctx context.Context, ch chan<- []*TargetGroup) {
-	var wg sync.WaitGroup
-
-	names := []string{
-		"_prometheus-http._tcp",
-		"_prometheus-https._tcp",
+// browse keeps querying spec.Name until ctx is cancelled, feeding every
+// response into reg and calling notify whenever the registry changes.
+// hashicorp/mdns only exposes one-shot queries rather than a genuine
+// subscription, so this re-queries every dd.interval. Each response updates
+// reg as soon as it arrives; an instance that stops answering is dropped
+// only when its TTL runs out (defaultServiceTTL for multicast responses),
+// or at once on a goodbye packet.
+func (dd *Discovery) browse(ctx context.Context, spec ServiceSpec, reg *serviceRegistry, notify func()) {
+	logger := dd.logger
+	if logger == nil {
+		// Guards direct callers (e.g. tests) that skip Run, which is the
+		// only place dd.logger is normally initialized.
+		logger = kitlog.NewNopLogger()
 	}
 
-	targetChan := make(chan *TargetGroup)
-	targets := make([]*TargetGroup, 0)
-
-	// Collect all lookup results into one list and emit it once they're all
-	// done.
-	go func() {
-		for target := range targetChan {
-			targets = append(targets, target)
+	for {
+		level.Debug(logger).Log("msg", "mdns query start", "service", spec.Name)
+		err := dd.refresh(ctx, spec, reg, notify)
+		level.Debug(logger).Log("msg", "mdns query finished", "service", spec.Name, "err", err)
+		if err != nil {
+			level.Warn(logger).Log("msg", "error refreshing DNS targets", "service", spec.Name, "err", err)
 		}
 
-		ch <- targets
-	}()
-
-	wg.Add(len(names))
-	for _, name := range names {
-		go func(n string) {
-			if err := dd.refresh(ctx, n, targetChan); err != nil {
-				//log.Errorf("Error refreshing DNS targets: %s", err)
-			}
-			wg.Done()
-		}(name)
+		select {
+		case <-time.After(dd.interval):
+		case <-ctx.Done():
+			return
+		}
 	}
-
-	// Close chan when all lookups are done
-	wg.Wait()
-	close(targetChan)
 }
 
 // TODO: Re-do so we select over ctx.Done(), a mdns response, mdns being done or an error
-func (dd *Discovery) refresh(ctx context.Context, name string, ch chan<- *TargetGroup) error {
-	// Set up output channel and read discovered data
-	responses := make(chan *mdns.ServiceEntry, 100)
-
-	// Do the actual lookup
-	go func() {
-		// TODO: Capture err somewhere
-		//err := mdns.Lookup(name, responses)
-		params := mdns.DefaultParams(name)
-		params.Entries = responses
-		if len(dd.ifaces) > 0 {
-			for _, iface := range dd.ifaces {
-				params.Interface = iface
-				mdns.Query(params)
-			}
-		} else {
-			mdns.Query(params)
-		}
-		close(responses)
-	}()
+func (dd *Discovery) refresh(ctx context.Context, spec ServiceSpec, reg *serviceRegistry, notify func()) error {
+	logger := dd.logger
+	if logger == nil {
+		// Guards direct callers (e.g. tests) that skip Run, which is the
+		// only place dd.logger is normally initialized.
+		logger = kitlog.NewNopLogger()
+	}
+
+	responses, err := dd.newResolver(spec.Name).Scan(ctx, multicastScanTimeout)
+	if err != nil {
+		return err
+	}
 
 	for {
 		select {
@@ -230,6 +330,17 @@ func (dd *Discovery) refresh(ctx context.Context, name string, ch chan<- *Target
 			if !chanOpen {
 				return nil
 			}
+			level.Debug(logger).Log("msg", "parsing mdns response", "service", spec.Name, "name", response.Name, "host", response.Host)
+
+			if response.Goodbye {
+				instance := strings.TrimRight(response.Name, ".")
+				level.Info(logger).Log("msg", "goodbye packet, removing target", "service", spec.Name, "instance", instance)
+				if reg.remove(instance) {
+					notify()
+				}
+				continue
+			}
+
 			if *ipv4Only && response.AddrV4 == nil {
 				continue
 			}
@@ -244,6 +355,19 @@ func (dd *Discovery) refresh(ctx context.Context, name string, ch chan<- *Target
 				Targets: []string{fmt.Sprintf("%s:%d", response.Host, response.Port)},
 			}
 
+			// Apply the service spec's default labels before anything
+			// derived from the response, so the latter can still win.
+			for k, v := range spec.Labels {
+				switch k {
+				case "scheme":
+					tg.Labels[model.SchemeLabel] = v
+				case "job":
+					tg.Labels[model.JobLabel] = v
+				default:
+					tg.Labels[model.MetaLabelPrefix+k] = v
+				}
+			}
+
 			// Set model.SchemeLabel to 'http' or 'https'
 			if strings.Contains(response.Name, "_prometheus-https._tcp") {
 				tg.Labels[model.SchemeLabel] = "https"
@@ -267,16 +391,38 @@ func (dd *Discovery) refresh(ctx context.Context, name string, ch chan<- *Target
 				}
 
 				tg.Labels[parts[0]] = parts[1]
+				level.Debug(logger).Log("msg", "decoded TXT field", "name", response.Name, "key", parts[0], "value", parts[1])
 			}
 
 			// Figure out an address
 			if response.AddrV4 != nil {
 				tg.Targets[0] = fmt.Sprintf("%s:%d", response.AddrV4, response.Port)
+				level.Debug(logger).Log("msg", "using IPv4 address", "name", response.Name, "addr", response.AddrV4)
 			} else if response.AddrV6 != nil {
 				tg.Targets[0] = fmt.Sprintf("[%s]:%d", response.AddrV6, response.Port)
+				level.Debug(logger).Log("msg", "falling back to IPv6 address", "name", response.Name, "addr", response.AddrV6)
+			}
+
+			if dd.labels != nil {
+				for k, v := range dd.labels.labels() {
+					tg.Labels[k] = v
+				}
+			}
+
+			ttl := response.TTL
+			if ttl <= 0 {
+				// The multicast path can't tell us the real TTL; fall back
+				// to a conservative default lease instead of never expiring.
+				ttl = defaultServiceTTL
 			}
 
-			ch <- tg
+			instance := strings.TrimRight(response.Name, ".")
+			reg.upsert(instance, tg, ttl, func() {
+				if reg.remove(instance) {
+					notify()
+				}
+			})
+			notify()
 		}
 	}
 }
@@ -0,0 +1,92 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultServiceTTL is the fallback lease length used to expire entries
+// whose real DNS TTL isn't known. The unicast resolver path reads the
+// actual TTL off the PTR record and upsert is called with that instead;
+// this constant only applies to multicast responses, since hashicorp/mdns
+// doesn't surface the raw TTL of those.
+const defaultServiceTTL = 2 * time.Minute
+
+// serviceRegistry is an in-memory set of target groups keyed by mDNS service
+// instance name (e.g. "myhost._prometheus-http._tcp.local"). Entries expire
+// on their own unless refreshed, so the registry reflects only services that
+// are actively being announced.
+type serviceRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*registryEntry
+}
+
+type registryEntry struct {
+	tg    *TargetGroup
+	timer *time.Timer
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{entries: make(map[string]*registryEntry)}
+}
+
+// upsert adds or refreshes the entry for instance, (re)arming its expiry
+// timer for ttl. onExpire runs from the timer's own goroutine if the entry
+// isn't refreshed again before ttl elapses.
+func (r *serviceRegistry) upsert(instance string, tg *TargetGroup, ttl time.Duration, onExpire func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[instance]; ok {
+		e.tg = tg
+		e.timer.Stop()
+		e.timer = time.AfterFunc(ttl, onExpire)
+		return
+	}
+
+	r.entries[instance] = &registryEntry{
+		tg:    tg,
+		timer: time.AfterFunc(ttl, onExpire),
+	}
+}
+
+// remove deletes instance from the registry, e.g. on TTL expiry or a
+// mDNS goodbye packet. It reports whether anything was removed, so callers
+// can avoid emitting a snapshot when nothing actually changed.
+func (r *serviceRegistry) remove(instance string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[instance]
+	if !ok {
+		return false
+	}
+	e.timer.Stop()
+	delete(r.entries, instance)
+	return true
+}
+
+// snapshot returns the current set of target groups.
+func (r *serviceRegistry) snapshot() []*TargetGroup {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*TargetGroup, 0, len(r.entries))
+	for _, e := range r.entries {
+		out = append(out, e.tg)
+	}
+	return out
+}
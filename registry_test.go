@@ -0,0 +1,71 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceRegistryExpiry(t *testing.T) {
+	reg := newServiceRegistry()
+	expired := make(chan string, 1)
+
+	reg.upsert("svc1._tcp.local.", &TargetGroup{Targets: []string{"10.0.0.1:9100"}}, 10*time.Millisecond, func() {
+		if reg.remove("svc1._tcp.local.") {
+			expired <- "svc1._tcp.local."
+		}
+	})
+
+	if got := len(reg.snapshot()); got != 1 {
+		t.Fatalf("snapshot length = %d, want 1", got)
+	}
+
+	select {
+	case name := <-expired:
+		if name != "svc1._tcp.local." {
+			t.Fatalf("expired = %q, want svc1._tcp.local.", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry did not expire in time")
+	}
+
+	if got := len(reg.snapshot()); got != 0 {
+		t.Fatalf("snapshot length after expiry = %d, want 0", got)
+	}
+}
+
+func TestServiceRegistryUpsertRefreshesExpiry(t *testing.T) {
+	reg := newServiceRegistry()
+	expired := make(chan struct{}, 1)
+	onExpire := func() {
+		if reg.remove("svc1._tcp.local.") {
+			expired <- struct{}{}
+		}
+	}
+
+	reg.upsert("svc1._tcp.local.", &TargetGroup{}, 50*time.Millisecond, onExpire)
+	time.Sleep(30 * time.Millisecond)
+	reg.upsert("svc1._tcp.local.", &TargetGroup{}, 50*time.Millisecond, onExpire) // refresh before expiry
+
+	select {
+	case <-expired:
+		t.Fatal("entry expired despite being refreshed")
+	case <-time.After(40 * time.Millisecond):
+	}
+
+	if got := len(reg.snapshot()); got != 1 {
+		t.Fatalf("snapshot length = %d, want 1", got)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/hashicorp/mdns"
+	"github.com/miekg/dns"
+)
+
+// multicastScanTimeout bounds how long a single interface's multicast
+// attempt gets before resolver falls back to a unicast query.
+const multicastScanTimeout = 3 * time.Second
+
+// ServiceEntry is what a Resolver produces for each discovered instance.
+// refresh doesn't care whether it came from multicast or the unicast
+// fallback.
+//
+// TTL and Goodbye carry real DNS-SD lease information when the resolver has
+// it: the unicast path reads it straight off the PTR record's answer TTL
+// (RFC 6762 §10), including the TTL=0 "goodbye" convention used to announce
+// a service is going away. hashicorp/mdns doesn't expose the raw TTL of a
+// multicast response, so entries from that path always have TTL == 0 and
+// Goodbye == false; refresh falls back to defaultServiceTTL for those.
+type ServiceEntry struct {
+	Name       string
+	Host       string
+	AddrV4     net.IP
+	AddrV6     net.IP
+	Port       int
+	InfoFields []string
+
+	// TTL is the lease duration from the DNS answer, or 0 if unknown.
+	TTL time.Duration
+	// Goodbye reports whether this entry is a TTL=0 removal announcement
+	// rather than a live instance.
+	Goodbye bool
+}
+
+func serviceEntryFromMDNS(e *mdns.ServiceEntry) *ServiceEntry {
+	return &ServiceEntry{
+		Name:       e.Name,
+		Host:       e.Host,
+		AddrV4:     e.AddrV4,
+		AddrV6:     e.AddrV6,
+		Port:       e.Port,
+		InfoFields: e.InfoFields,
+	}
+}
+
+// Resolver discovers instances of a single mDNS/DNS-SD service type. It
+// exists as an interface mainly so refresh's callers can swap in a fake for
+// tests rather than requiring a live network.
+type Resolver interface {
+	Scan(ctx context.Context, timeout time.Duration) (<-chan *ServiceEntry, error)
+}
+
+// mdnsResolver is the production Resolver. Plain multicast mDNS joins fail
+// silently on platforms such as Android or locked-down container networks,
+// so it queries interface-by-interface and, for any interface that yields
+// nothing within timeout, falls back to a unicast query against dnsServer
+// for the same PTR/SRV/TXT records.
+type mdnsResolver struct {
+	name      string
+	ifaces    []*net.Interface
+	dnsServer string // host:port; unicast fallback is skipped if empty
+	logger    kitlog.Logger
+}
+
+func newMDNSResolver(name string, ifaces []*net.Interface, dnsServer string, logger kitlog.Logger) *mdnsResolver {
+	if logger == nil {
+		logger = kitlog.NewNopLogger()
+	}
+	return &mdnsResolver{name: name, ifaces: ifaces, dnsServer: dnsServer, logger: logger}
+}
+
+func (r *mdnsResolver) Scan(ctx context.Context, timeout time.Duration) (<-chan *ServiceEntry, error) {
+	ifaces := r.ifaces
+	if len(ifaces) == 0 {
+		up, err := multicastCapableInterfaces()
+		if err != nil {
+			return nil, err
+		}
+		ifaces = up
+	}
+
+	out := make(chan *ServiceEntry, 100)
+
+	go func() {
+		defer close(out)
+
+		if len(ifaces) == 0 {
+			// Nothing multicast-capable at all; go straight to unicast.
+			level.Debug(r.logger).Log("msg", "no multicast-capable interfaces, using unicast fallback", "service", r.name)
+			r.scanUnicast(ctx, out)
+			return
+		}
+
+		for _, iface := range ifaces {
+			if n := r.scanMulticast(ctx, iface, timeout, out); n == 0 {
+				level.Debug(r.logger).Log("msg", "multicast query returned nothing, falling back to unicast", "service", r.name, "iface", iface.Name)
+				r.scanUnicast(ctx, out)
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// scanMulticast runs one multicast query against iface, forwards every
+// entry it gets to out, and reports how many entries were found.
+func (r *mdnsResolver) scanMulticast(ctx context.Context, iface *net.Interface, timeout time.Duration, out chan<- *ServiceEntry) (n int) {
+	responses := make(chan *mdns.ServiceEntry, 32)
+
+	level.Debug(r.logger).Log("msg", "mdns query start", "service", r.name, "iface", iface.Name)
+	defer func() {
+		level.Debug(r.logger).Log("msg", "mdns query finished", "service", r.name, "iface", iface.Name, "entries", n)
+	}()
+
+	go func() {
+		params := mdns.DefaultParams(r.name)
+		params.Interface = iface
+		params.Timeout = timeout
+		params.Entries = responses
+		mdns.Query(params)
+		close(responses)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return n
+		case entry, ok := <-responses:
+			if !ok {
+				return n
+			}
+			n++
+			// hashicorp/mdns doesn't surface the response's DNS TTL, so this
+			// entry's TTL/Goodbye are left at their zero values; refresh
+			// falls back to defaultServiceTTL for it.
+			out <- serviceEntryFromMDNS(entry)
+		}
+	}
+}
+
+// scanUnicast falls back to direct DNS queries against r.dnsServer for the
+// PTR/SRV/TXT/A/AAAA records that make up r.name, for networks where
+// multicast joins don't work at all.
+func (r *mdnsResolver) scanUnicast(ctx context.Context, out chan<- *ServiceEntry) {
+	if r.dnsServer == "" {
+		return
+	}
+
+	level.Debug(r.logger).Log("msg", "unicast DNS query start", "service", r.name, "server", r.dnsServer)
+
+	c := &dns.Client{Timeout: 5 * time.Second}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(r.name+".local"), dns.TypePTR)
+	in, _, err := c.ExchangeContext(ctx, m, r.dnsServer)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "unicast DNS query failed", "service", r.name, "server", r.dnsServer, "err", err)
+		return
+	}
+
+	for _, ans := range in.Answer {
+		ptr, ok := ans.(*dns.PTR)
+		if !ok {
+			continue
+		}
+
+		// RFC 6762 §10.1: a PTR record with TTL=0 is a "goodbye" packet
+		// announcing the instance is going away right now, not a lease to
+		// resolve and track.
+		if ptr.Hdr.Ttl == 0 {
+			level.Debug(r.logger).Log("msg", "received goodbye packet", "service", r.name, "instance", ptr.Ptr)
+			out <- &ServiceEntry{Name: ptr.Ptr, Goodbye: true}
+			continue
+		}
+
+		if entry := r.resolveInstance(ctx, c, ptr.Ptr, time.Duration(ptr.Hdr.Ttl)*time.Second); entry != nil {
+			out <- entry
+		}
+	}
+}
+
+// resolveInstance issues the SRV, TXT and address lookups for a single
+// service instance discovered via a PTR record, assembling them into a
+// ServiceEntry matching what mdns.Query would have produced. ttl is the
+// lease duration taken from the triggering PTR record's answer TTL.
+func (r *mdnsResolver) resolveInstance(ctx context.Context, c *dns.Client, instance string, ttl time.Duration) *ServiceEntry {
+	srvQuery := new(dns.Msg)
+	srvQuery.SetQuestion(instance, dns.TypeSRV)
+	in, _, err := c.ExchangeContext(ctx, srvQuery, r.dnsServer)
+	if err != nil || len(in.Answer) == 0 {
+		return nil
+	}
+	srv, ok := in.Answer[0].(*dns.SRV)
+	if !ok {
+		return nil
+	}
+
+	entry := &ServiceEntry{
+		Name: instance,
+		Host: srv.Target,
+		Port: int(srv.Port),
+		TTL:  ttl,
+	}
+
+	for _, ip := range r.resolveAddrs(ctx, c, srv.Target) {
+		if ip4 := ip.To4(); ip4 != nil {
+			entry.AddrV4 = ip4
+		} else {
+			entry.AddrV6 = ip
+		}
+	}
+
+	txtQuery := new(dns.Msg)
+	txtQuery.SetQuestion(instance, dns.TypeTXT)
+	if in, _, err := c.ExchangeContext(ctx, txtQuery, r.dnsServer); err == nil {
+		for _, ans := range in.Answer {
+			if txt, ok := ans.(*dns.TXT); ok {
+				entry.InfoFields = append(entry.InfoFields, txt.Txt...)
+			}
+		}
+	}
+
+	return entry
+}
+
+func (r *mdnsResolver) resolveAddrs(ctx context.Context, c *dns.Client, host string) []net.IP {
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(host, qtype)
+		in, _, err := c.ExchangeContext(ctx, m, r.dnsServer)
+		if err != nil {
+			continue
+		}
+		for _, ans := range in.Answer {
+			switch rec := ans.(type) {
+			case *dns.A:
+				ips = append(ips, rec.A)
+			case *dns.AAAA:
+				ips = append(ips, rec.AAAA)
+			}
+		}
+	}
+	return ips
+}
+
+// multicastCapableInterfaces returns the up, multicast-capable interfaces
+// suitable for joining the mDNS group. Platforms like Android frequently
+// report interfaces that can't actually join multicast groups despite the
+// flag, which is exactly the case the unicast fallback exists for.
+func multicastCapableInterfaces() ([]*net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var up []*net.Interface
+	for i := range all {
+		iface := all[i]
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		up = append(up, &iface)
+	}
+	return up, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/mdns"
+)
+
+// metaServiceName is the well-known DNS-SD meta-service used to enumerate
+// which service types are being advertised on the LAN. See RFC 6763 §9.
+const metaServiceName = "_services._dns-sd._udp"
+
+// ServiceSpec describes one mDNS service type to browse for, along with the
+// default labels that should be applied to every TargetGroup it produces.
+// Defaults are overridden by anything refresh derives from the response
+// itself, such as the scheme implied by "_prometheus-https._tcp".
+type ServiceSpec struct {
+	Name   string
+	Labels map[string]string
+}
+
+// String renders the spec back into the "-service" flag syntax.
+func (s ServiceSpec) String() string {
+	if len(s.Labels) == 0 {
+		return s.Name
+	}
+
+	pairs := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		pairs = append(pairs, k+":"+v)
+	}
+	return s.Name + "=" + strings.Join(pairs, ",")
+}
+
+// parseServiceSpec parses a "-service" flag value of the form
+// "_node-exporter._tcp=scheme:http,job:node" into a ServiceSpec. The
+// "=labels" part is optional.
+func parseServiceSpec(value string) (ServiceSpec, error) {
+	name := value
+	labels := map[string]string{}
+
+	if i := strings.IndexByte(value, '='); i >= 0 {
+		name = value[:i]
+		for _, pair := range strings.Split(value[i+1:], ",") {
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 {
+				return ServiceSpec{}, fmt.Errorf("invalid label %q in -service %q, want key:value", pair, value)
+			}
+			labels[kv[0]] = kv[1]
+		}
+	}
+
+	if name == "" {
+		return ServiceSpec{}, fmt.Errorf("invalid -service %q, missing service name", value)
+	}
+
+	return ServiceSpec{Name: name, Labels: labels}, nil
+}
+
+// serviceSpecs collects repeated "-service" flag occurrences into a
+// []ServiceSpec.
+type serviceSpecs []ServiceSpec
+
+func (s *serviceSpecs) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, len(*s))
+	for i, spec := range *s {
+		parts[i] = spec.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *serviceSpecs) Set(value string) error {
+	spec, err := parseServiceSpec(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, spec)
+	return nil
+}
+
+// loadServiceConfigFile reads additional service specs from path, one per
+// line in the same syntax as the "-service" flag
+// (e.g. "_node-exporter._tcp=scheme:http,job:node"). Blank lines and lines
+// starting with "#" are ignored.
+func loadServiceConfigFile(path string) (serviceSpecs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs serviceSpecs
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		spec, err := parseServiceSpec(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		specs = append(specs, spec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return specs, nil
+}
+
+// discoverServiceNames queries the DNS-SD meta-service to find out which
+// service types are actually being advertised on the LAN, returning names
+// such as "_prometheus-http._tcp" suitable for another mdns.Query.
+func discoverServiceNames(ctx context.Context, dd *Discovery) ([]string, error) {
+	responses := make(chan *mdns.ServiceEntry, 100)
+
+	go func() {
+		params := mdns.DefaultParams(metaServiceName)
+		params.Entries = responses
+		if len(dd.ifaces) > 0 {
+			for _, iface := range dd.ifaces {
+				params.Interface = iface
+				mdns.Query(params)
+			}
+		} else {
+			mdns.Query(params)
+		}
+		close(responses)
+	}()
+
+	var names []string
+	seen := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return names, ctx.Err()
+		case response, chanOpen := <-responses:
+			if !chanOpen {
+				return names, nil
+			}
+			name := strings.TrimSuffix(strings.TrimRight(response.Name, "."), ".local")
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+}